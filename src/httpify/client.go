@@ -12,10 +12,11 @@ import (
 	"net/http"
 	"net/url"
 	"runtime"
-	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/net/http2"
+
 	"github.com/Shopify/themekit/src/ratelimiter"
 	"github.com/Shopify/themekit/src/release"
 )
@@ -30,17 +31,61 @@ type Params struct {
 	Password string
 	Proxy    string
 	Timeout  time.Duration
+
+	// InsecureSkipVerify disables TLS certificate verification. This should
+	// only ever be used for local testing against something like an
+	// httptest server; it must never be true against Shopify.
+	InsecureSkipVerify bool
+	// CACertFile, when set, is used instead of the system cert pool to
+	// verify the server certificate. This is needed when Shopify is
+	// reached through a corporate proxy that re-signs TLS traffic with an
+	// internal CA.
+	CACertFile string
+	// ClientCertFile and ClientKeyFile, when both set, are presented to the
+	// server for mutual TLS authentication.
+	ClientCertFile string
+	ClientKeyFile  string
+	// ServerName overrides the hostname used for certificate verification
+	// and SNI, which is useful when Domain is an IP or a proxy address.
+	ServerName string
+
+	// MaxRetry caps the number of retry attempts for a retryable response
+	// or connection error. Defaults to 5 when zero.
+	MaxRetry int
+	// BackoffBase and BackoffCap tune the exponential backoff used between
+	// retries that aren't driven by a Retry-After header. Default to 1
+	// second and 30 seconds respectively when zero.
+	BackoffBase time.Duration
+	BackoffCap  time.Duration
+
+	// Transport, when set, replaces the RoundTripper themekit builds from
+	// the rest of Params (TLS, proxy, connection pooling). This is the
+	// seam for dropping in an httptest server's transport directly, or any
+	// other RoundTripper that doesn't need those settings.
+	Transport http.RoundTripper
+	// Middleware wraps the base RoundTripper, in order, so callers can
+	// layer in logging, tracing, metrics, or fixture recording without
+	// forking this package. Middleware[0] is the outermost layer.
+	Middleware []func(http.RoundTripper) http.RoundTripper
+
+	// MaxConnsPerHost and IdleConnTimeout tune the connection pool used for
+	// concurrent asset uploads during deploy. Default to 64 and 90 seconds
+	// respectively when zero; set them lower on constrained networks.
+	MaxConnsPerHost int
+	IdleConnTimeout time.Duration
 }
 
 // HTTPClient encapsulates an authenticate http client to issue theme requests
 // to Shopify
 type HTTPClient struct {
-	domain   string
-	password string
-	baseURL  *url.URL
-	client   *http.Client
-	limit    *ratelimiter.Limiter
-	maxRetry int
+	domain      string
+	password    string
+	baseURL     *url.URL
+	client      *http.Client
+	limit       *ratelimiter.Limiter
+	maxRetry    int
+	backoffBase time.Duration
+	backoffCap  time.Duration
 }
 
 // NewClient will create a new authenticated http client that will communicate
@@ -51,46 +96,92 @@ func NewClient(params Params) (*HTTPClient, error) {
 		return nil, err
 	}
 
-	adapter, err := generateHTTPAdapter(params.Timeout, params.Proxy)
+	tlsConfig, err := generateTLSConfig(params)
 	if err != nil {
 		return nil, err
 	}
 
+	adapter, err := generateHTTPAdapter(params, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	maxRetry := params.MaxRetry
+	if maxRetry == 0 {
+		maxRetry = 5
+	}
+	backoffBase := params.BackoffBase
+	if backoffBase == 0 {
+		backoffBase = time.Second
+	}
+	backoffCap := params.BackoffCap
+	if backoffCap == 0 {
+		backoffCap = 30 * time.Second
+	}
+
 	return &HTTPClient{
-		domain:   params.Domain,
-		password: params.Password,
-		baseURL:  baseURL,
-		client:   adapter,
-		limit:    ratelimiter.New(params.Domain, 4),
-		maxRetry: 5,
+		domain:      params.Domain,
+		password:    params.Password,
+		baseURL:     baseURL,
+		client:      adapter,
+		limit:       ratelimiter.New(params.Domain, 4),
+		maxRetry:    maxRetry,
+		backoffBase: backoffBase,
+		backoffCap:  backoffCap,
 	}, nil
 }
 
 // Get will send a get request to the path provided
 func (client *HTTPClient) Get(path string, headers map[string]string) (*http.Response, error) {
-	return client.do("GET", path, nil, headers)
+	return client.GetCtx(context.Background(), path, headers)
+}
+
+// GetCtx will send a get request to the path provided, aborting early if ctx
+// is cancelled before the request (including retries) completes.
+func (client *HTTPClient) GetCtx(ctx context.Context, path string, headers map[string]string) (*http.Response, error) {
+	return client.do(ctx, "GET", path, nil, headers)
 }
 
 // Post will send a Post request to the path provided and set the post body as the
 // object passed
 func (client *HTTPClient) Post(path string, body interface{}, headers map[string]string) (*http.Response, error) {
-	return client.do("POST", path, body, headers)
+	return client.PostCtx(context.Background(), path, body, headers)
+}
+
+// PostCtx will send a Post request to the path provided and set the post
+// body as the object passed, aborting early if ctx is cancelled before the
+// request (including retries) completes.
+func (client *HTTPClient) PostCtx(ctx context.Context, path string, body interface{}, headers map[string]string) (*http.Response, error) {
+	return client.do(ctx, "POST", path, body, headers)
 }
 
 // Put will send a Put request to the path provided and set the post body as the
 // object passed
 func (client *HTTPClient) Put(path string, body interface{}, headers map[string]string) (*http.Response, error) {
-	return client.do("PUT", path, body, headers)
+	return client.PutCtx(context.Background(), path, body, headers)
+}
+
+// PutCtx will send a Put request to the path provided and set the post body
+// as the object passed, aborting early if ctx is cancelled before the
+// request (including retries) completes.
+func (client *HTTPClient) PutCtx(ctx context.Context, path string, body interface{}, headers map[string]string) (*http.Response, error) {
+	return client.do(ctx, "PUT", path, body, headers)
 }
 
 // Delete will send a delete request to the path provided
 func (client *HTTPClient) Delete(path string, headers map[string]string) (*http.Response, error) {
-	return client.do("DELETE", path, nil, headers)
+	return client.DeleteCtx(context.Background(), path, headers)
+}
+
+// DeleteCtx will send a delete request to the path provided, aborting early
+// if ctx is cancelled before the request (including retries) completes.
+func (client *HTTPClient) DeleteCtx(ctx context.Context, path string, headers map[string]string) (*http.Response, error) {
+	return client.do(ctx, "DELETE", path, nil, headers)
 }
 
 // do will issue an authenticated json request to shopify.
-func (client *HTTPClient) do(method, path string, body interface{}, headers map[string]string) (*http.Response, error) {
-	req, err := http.NewRequest(method, client.baseURL.String()+path, nil)
+func (client *HTTPClient) do(ctx context.Context, method, path string, body interface{}, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, client.baseURL.String()+path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -107,6 +198,7 @@ func (client *HTTPClient) do(method, path string, body interface{}, headers map[
 }
 
 func (client *HTTPClient) doWithRetry(req *http.Request, body interface{}) (*http.Response, error) {
+	ctx := req.Context()
 	for attempt := 0; attempt <= client.maxRetry; {
 		// reset the body when non-nil for every request (rewind)
 		if body != nil {
@@ -117,78 +209,150 @@ func (client *HTTPClient) doWithRetry(req *http.Request, body interface{}) (*htt
 			req.Body = ioutil.NopCloser(bytes.NewBuffer(data))
 		}
 
-		client.limit.Wait()
+		if err := client.waitForLimit(ctx); err != nil {
+			return nil, err
+		}
 		resp, err := client.client.Do(req)
+		skipJitterSleep := false
 		if err == nil {
-			if resp.StatusCode >= 100 && resp.StatusCode <= 428 {
+			switch {
+			case resp.StatusCode <= 428:
+				return resp, nil
+			case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+				drainAndClose(resp.Body)
+				if after, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+					// The limiter reset already accounts for the wait, so
+					// don't also pay the jitter backoff below. The wait is
+					// floored by parseRetryAfter so a 0 or past-dated
+					// Retry-After can't turn this into a busy loop.
+					client.limit.ResetAfter(after)
+					skipJitterSleep = true
+				}
+			case resp.StatusCode < http.StatusInternalServerError:
 				return resp, nil
-			} else if resp.StatusCode == http.StatusTooManyRequests {
-				after, _ := strconv.ParseFloat(resp.Header.Get("Retry-After"), 10)
-				client.limit.ResetAfter(time.Duration(after))
-				continue
+			default:
+				drainAndClose(resp.Body)
 			}
 		} else if strings.Contains(err.Error(), "no such host") {
 			return nil, errConnectionIssue
 		}
+
+		// Every retryable outcome counts against maxRetry, including
+		// Retry-After driven ones, so a server that keeps returning
+		// 429/503 can't retry unboundedly.
 		attempt++
-		time.Sleep(time.Duration(attempt) * time.Second)
+		if skipJitterSleep {
+			continue
+		}
+		if err := client.sleepBackoff(ctx, attempt); err != nil {
+			return nil, err
+		}
 	}
 	return nil, fmt.Errorf("request failed after %v retries", client.maxRetry)
 }
 
-func generateHTTPAdapter(timeout time.Duration, proxyURL string) (*http.Client, error) {
-	transport, err := generateClientTransport(proxyURL)
-	if err != nil {
-		return nil, err
+func generateHTTPAdapter(params Params, tlsConfig *tls.Config) (*http.Client, error) {
+	transport := params.Transport
+	if transport == nil {
+		var err error
+		if transport, err = generateClientTransport(params.Proxy, tlsConfig, params.MaxConnsPerHost, params.IdleConnTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := len(params.Middleware) - 1; i >= 0; i-- {
+		transport = params.Middleware[i](transport)
 	}
+
 	return &http.Client{
 		Transport: transport,
-		Timeout:   timeout,
+		Timeout:   params.Timeout,
 	}, nil
 }
 
-func generateClientTransport(proxyURL string) (*http.Transport, error) {
-	var proxy func(*http.Request) (*url.URL, error)
-	if proxyURL != "" {
-		parsedURL, err := url.ParseRequestURI(proxyURL)
-		if err != nil {
-			return nil, fmt.Errorf("invalid proxy URI")
-		}
-		proxy = http.ProxyURL(parsedURL)
+func generateClientTransport(proxyURL string, tlsConfig *tls.Config, maxConnsPerHost int, idleConnTimeout time.Duration) (*http.Transport, error) {
+	if maxConnsPerHost == 0 {
+		maxConnsPerHost = 64
+	}
+	if idleConnTimeout == 0 {
+		idleConnTimeout = 90 * time.Second
 	}
 
-	return &http.Transport{
+	proxy, dial, err := generateProxyFunc(proxyURL, idleConnTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
 		Proxy:                 proxy,
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-		IdleConnTimeout:       time.Second,
+		TLSClientConfig:       tlsConfig,
+		IdleConnTimeout:       idleConnTimeout,
 		TLSHandshakeTimeout:   time.Second,
 		ExpectContinueTimeout: time.Second,
 		ResponseHeaderTimeout: time.Second,
-		MaxIdleConnsPerHost:   10,
-		DialContext:           newDialContextDialer(),
-	}, nil
+		MaxIdleConnsPerHost:   maxConnsPerHost / 2,
+		MaxConnsPerHost:       maxConnsPerHost,
+		ForceAttemptHTTP2:     true,
+		DialContext:           dial,
+	}
+
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, fmt.Errorf("could not configure HTTP/2: %v", err)
+	}
+
+	return transport, nil
 }
 
 type contextDialer func(ctx context.Context, network, address string) (net.Conn, error)
 
-func newDialContextDialer() contextDialer {
-	dialer := &net.Dialer{
-		Timeout:   3 * time.Second,
-		KeepAlive: 1 * time.Second,
+// newDialContextDialer wraps base (the stdlib dialer by default, or a SOCKS5
+// dialer when Params.Proxy is a socks5:// URL) so that every connection
+// still gets an idle deadline, reset on every Read/Write rather than set
+// once at dial time. idleTimeout is kept equal to the transport's
+// IdleConnTimeout so pooled HTTP/2 keep-alives (which block in a Read for
+// the whole time they sit idle) survive exactly as long as the pool means
+// to keep them, instead of being cut off earlier; a connection that's
+// merely slow mid-transfer gets its deadline pushed forward on every byte,
+// so it is never cut off mid-flight.
+func newDialContextDialer(base contextDialer, idleTimeout time.Duration) contextDialer {
+	if base == nil {
+		base = (&net.Dialer{
+			Timeout:   3 * time.Second,
+			KeepAlive: 1 * time.Second,
+		}).DialContext
 	}
-	return func(ctx context.Context, network, address string) (conn net.Conn, err error) {
-		if conn, err = dialer.DialContext(ctx, network, address); err != nil {
-			return nil, err
-		}
-		deadline := time.Now().Add(5 * time.Second)
-		if err := conn.SetDeadline(deadline); err != nil {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := base(ctx, network, address)
+		if err != nil {
 			return nil, err
 		}
-		if err := conn.SetReadDeadline(deadline); err != nil {
+		if err := conn.SetDeadline(time.Now().Add(idleTimeout)); err != nil {
 			return nil, err
 		}
-		return conn, nil
+		return &idleDeadlineConn{Conn: conn, timeout: idleTimeout}, nil
+	}
+}
+
+// idleDeadlineConn pushes the connection's deadline forward by timeout on
+// every Read/Write, turning the one-shot dial-time deadline into a rolling
+// idle timeout.
+type idleDeadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleDeadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *idleDeadlineConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
 	}
+	return c.Conn.Write(b)
 }
 
 func parseBaseURL(domain string) (*url.URL, error) {
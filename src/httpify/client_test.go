@@ -0,0 +1,76 @@
+package httpify
+
+import (
+	"net/http"
+	"testing"
+)
+
+// recordingTransport is a stub http.RoundTripper that returns a canned
+// response without making a network call.
+type recordingTransport struct{}
+
+func (recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: http.Header{}}, nil
+}
+
+// markingMiddleware wraps next so that RoundTrip appends name to order
+// before delegating, letting a test observe call order.
+func markingMiddleware(order *[]string, name string) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			*order = append(*order, name)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestGenerateHTTPAdapter_MiddlewareOrder(t *testing.T) {
+	var order []string
+	params := Params{
+		Transport: recordingTransport{},
+		Middleware: []func(http.RoundTripper) http.RoundTripper{
+			markingMiddleware(&order, "outer"),
+			markingMiddleware(&order, "inner"),
+		},
+	}
+
+	adapter, err := generateHTTPAdapter(params, nil)
+	if err != nil {
+		t.Fatalf("generateHTTPAdapter returned error: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest returned error: %v", err)
+	}
+	if _, err := adapter.Transport.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip returned error: %v", err)
+	}
+
+	want := []string{"outer", "inner"}
+	if len(order) != len(want) {
+		t.Fatalf("call order = %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("call order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestGenerateHTTPAdapter_NoMiddlewareUsesTransportAsIs(t *testing.T) {
+	transport := recordingTransport{}
+	adapter, err := generateHTTPAdapter(Params{Transport: transport}, nil)
+	if err != nil {
+		t.Fatalf("generateHTTPAdapter returned error: %v", err)
+	}
+	if adapter.Transport != transport {
+		t.Fatalf("adapter.Transport = %v, want the supplied stub transport unchanged", adapter.Transport)
+	}
+}
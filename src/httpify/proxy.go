@@ -0,0 +1,59 @@
+package httpify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// generateProxyFunc resolves Params.Proxy into the pieces a *http.Transport
+// needs: a Proxy func for HTTP(S) proxying, and a dialer to use for the
+// underlying connection. When proxyURL is empty, standard environment
+// variables (HTTP_PROXY/HTTPS_PROXY/NO_PROXY) are honored via
+// http.ProxyFromEnvironment. When it is set to an HTTP(S) proxy, NO_PROXY is
+// still consulted so that an explicit proxy doesn't override exclusions CI
+// systems rely on. A socks5:// proxyURL installs a SOCKS5 dialer instead of
+// an HTTP CONNECT proxy; every connection then goes through it and NO_PROXY
+// is not consulted. idleConnTimeout is passed straight through to the dialer so its
+// rolling idle deadline matches the transport's IdleConnTimeout.
+func generateProxyFunc(proxyURL string, idleConnTimeout time.Duration) (func(*http.Request) (*url.URL, error), contextDialer, error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, newDialContextDialer(nil, idleConnTimeout), nil
+	}
+
+	parsedURL, err := url.ParseRequestURI(proxyURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid proxy URI")
+	}
+
+	if parsedURL.Scheme == "socks5" {
+		dialer, err := proxy.FromURL(parsedURL, proxy.Direct)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid socks5 proxy URI: %v", err)
+		}
+		contextDial := func(ctx context.Context, network, address string) (net.Conn, error) {
+			if ctxDialer, ok := dialer.(proxy.ContextDialer); ok {
+				return ctxDialer.DialContext(ctx, network, address)
+			}
+			return dialer.Dial(network, address)
+		}
+		return nil, newDialContextDialer(contextDial, idleConnTimeout), nil
+	}
+
+	config := &httpproxy.Config{
+		HTTPProxy:  proxyURL,
+		HTTPSProxy: proxyURL,
+		NoProxy:    os.Getenv("NO_PROXY"),
+	}
+	proxyFunc := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}, newDialContextDialer(nil, idleConnTimeout), nil
+}
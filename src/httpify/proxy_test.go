@@ -0,0 +1,69 @@
+package httpify
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGenerateProxyFunc_ExplicitProxyHonorsNoProxy(t *testing.T) {
+	oldNoProxy := os.Getenv("NO_PROXY")
+	defer os.Setenv("NO_PROXY", oldNoProxy)
+	os.Setenv("NO_PROXY", "excluded.myshopify.com")
+
+	proxyFunc, dial, err := generateProxyFunc("http://proxy.example.com:8080", time.Minute)
+	if err != nil {
+		t.Fatalf("generateProxyFunc returned error: %v", err)
+	}
+	if dial == nil {
+		t.Fatal("generateProxyFunc returned a nil dialer")
+	}
+
+	excludedReq := &http.Request{URL: &url.URL{Scheme: "https", Host: "excluded.myshopify.com"}}
+	if got, err := proxyFunc(excludedReq); err != nil || got != nil {
+		t.Fatalf("proxyFunc for NO_PROXY host = (%v, %v), want (nil, nil)", got, err)
+	}
+
+	allowedReq := &http.Request{URL: &url.URL{Scheme: "https", Host: "allowed.myshopify.com"}}
+	got, err := proxyFunc(allowedReq)
+	if err != nil {
+		t.Fatalf("proxyFunc returned error: %v", err)
+	}
+	if got == nil || got.Host != "proxy.example.com:8080" {
+		t.Fatalf("proxyFunc for allowed host = %v, want proxy.example.com:8080", got)
+	}
+}
+
+func TestGenerateProxyFunc_Environment(t *testing.T) {
+	proxyFunc, dial, err := generateProxyFunc("", time.Minute)
+	if err != nil {
+		t.Fatalf("generateProxyFunc returned error: %v", err)
+	}
+	if proxyFunc == nil {
+		t.Fatal("generateProxyFunc with no explicit proxy should still fall back to http.ProxyFromEnvironment")
+	}
+	if dial == nil {
+		t.Fatal("generateProxyFunc returned a nil dialer")
+	}
+}
+
+func TestGenerateProxyFunc_Socks5(t *testing.T) {
+	proxyFunc, dial, err := generateProxyFunc("socks5://127.0.0.1:1080", time.Minute)
+	if err != nil {
+		t.Fatalf("generateProxyFunc returned error: %v", err)
+	}
+	if proxyFunc != nil {
+		t.Fatal("a socks5 proxy should be installed as a dialer, not an http.Transport.Proxy func")
+	}
+	if dial == nil {
+		t.Fatal("generateProxyFunc returned a nil dialer for a socks5 proxy")
+	}
+}
+
+func TestGenerateProxyFunc_InvalidURI(t *testing.T) {
+	if _, _, err := generateProxyFunc("://not-a-uri", time.Minute); err == nil {
+		t.Fatal("expected an error for an invalid proxy URI")
+	}
+}
@@ -0,0 +1,103 @@
+package httpify
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// waitForLimit blocks until client.limit allows the next request, aborting
+// early if ctx is cancelled. ratelimiter.Limiter.Wait takes no context of
+// its own, so a cancelled watch shutdown would otherwise block for up to
+// the full Retry-After window a 429/503 just set via ResetAfter. Bail out
+// before even starting the wait if ctx is already done, so a shutdown that
+// raced a burst of cancelled requests doesn't spawn a goroutine per request
+// for a wait nobody will observe.
+func (client *HTTPClient) waitForLimit(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		client.limit.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleepBackoff waits out the backoff for the given attempt, aborting early
+// if ctx is cancelled so a caller's shutdown isn't stuck behind a long
+// retry sleep.
+func (client *HTTPClient) sleepBackoff(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(fullJitterBackoff(client.backoffBase, client.backoffCap, attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drainAndClose discards a response body and closes it so the underlying
+// connection can be reused for keep-alive (and, over HTTP/2, so its stream
+// isn't pinned) instead of being abandoned on a retry.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, body)
+	body.Close()
+}
+
+// fullJitterBackoff implements the "full jitter" strategy described in
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/:
+// sleep = rand(0, min(cap, base * 2^attempt)).
+func fullJitterBackoff(base, cap time.Duration, attempt int) time.Duration {
+	upper := float64(base) * math.Pow(2, float64(attempt))
+	if upper > float64(cap) || upper <= 0 {
+		upper = float64(cap)
+	}
+	return time.Duration(rand.Int63n(int64(upper) + 1))
+}
+
+// minRetryAfter floors the wait parseRetryAfter reports. Without it, a
+// Retry-After of 0 or a past HTTP-date would reset the limiter with no
+// wait at all, turning a persistently failing endpoint into a busy loop
+// bounded only by maxRetry.
+const minRetryAfter = time.Second
+
+// parseRetryAfter parses a Retry-After header in either of its two valid
+// forms: an integer/float number of delta-seconds, or an HTTP-date. The
+// returned duration is floored at minRetryAfter. It returns false when
+// header is empty or unparseable as either form.
+func parseRetryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseFloat(header, 64); err == nil {
+		return floorRetryAfter(time.Duration(seconds * float64(time.Second))), true
+	}
+
+	if when, err := http.ParseTime(header); err == nil {
+		return floorRetryAfter(time.Until(when)), true
+	}
+
+	return 0, false
+}
+
+func floorRetryAfter(d time.Duration) time.Duration {
+	if d < minRetryAfter {
+		return minRetryAfter
+	}
+	return d
+}
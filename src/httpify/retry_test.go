@@ -0,0 +1,69 @@
+package httpify
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		wantOK  bool
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{name: "empty header", header: "", wantOK: false},
+		{name: "garbage header", header: "not-a-value", wantOK: false},
+		{name: "delta seconds", header: "5", wantOK: true, wantMin: 5 * time.Second, wantMax: 5 * time.Second},
+		{name: "fractional delta seconds", header: "1.5", wantOK: true, wantMin: 1500 * time.Millisecond, wantMax: 1500 * time.Millisecond},
+		{name: "zero is floored", header: "0", wantOK: true, wantMin: minRetryAfter, wantMax: minRetryAfter},
+		{name: "negative is floored", header: "-10", wantOK: true, wantMin: minRetryAfter, wantMax: minRetryAfter},
+		{name: "future HTTP-date", header: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), wantOK: true, wantMin: 59 * time.Minute, wantMax: time.Hour},
+		{name: "past HTTP-date is floored", header: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), wantOK: true, wantMin: minRetryAfter, wantMax: minRetryAfter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.header)
+			if ok != tt.wantOK {
+				t.Fatalf("parseRetryAfter(%q) ok = %v, want %v", tt.header, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got < tt.wantMin || got > tt.wantMax {
+				t.Fatalf("parseRetryAfter(%q) = %v, want between %v and %v", tt.header, got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestFullJitterBackoff(t *testing.T) {
+	base := 100 * time.Millisecond
+	cap := time.Second
+
+	for attempt := 0; attempt < 10; attempt++ {
+		for i := 0; i < 100; i++ {
+			got := fullJitterBackoff(base, cap, attempt)
+			if got < 0 {
+				t.Fatalf("fullJitterBackoff(attempt=%d) = %v, want >= 0", attempt, got)
+			}
+			if got > cap {
+				t.Fatalf("fullJitterBackoff(attempt=%d) = %v, want <= cap %v", attempt, got, cap)
+			}
+		}
+	}
+}
+
+func TestFullJitterBackoffNeverExceedsCapEvenAtHighAttempts(t *testing.T) {
+	base := time.Second
+	cap := 5 * time.Second
+
+	for i := 0; i < 100; i++ {
+		if got := fullJitterBackoff(base, cap, 20); got > cap {
+			t.Fatalf("fullJitterBackoff(attempt=20) = %v, want <= cap %v", got, cap)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package httpify
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// generateTLSConfig builds the *tls.Config used for every request this
+// client makes. It is built once at NewClient time so that cert files are
+// read and parsed a single time rather than on every request.
+func generateTLSConfig(params Params) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: params.InsecureSkipVerify,
+		ServerName:         params.ServerName,
+	}
+
+	if params.CACertFile != "" {
+		pool, err := loadCACertPool(params.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if params.ClientCertFile != "" || params.ClientKeyFile != "" {
+		if params.ClientCertFile == "" || params.ClientKeyFile == "" {
+			return nil, fmt.Errorf("both ClientCertFile and ClientKeyFile must be set to use mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(params.ClientCertFile, params.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate/key: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func loadCACertPool(caCertFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA cert file %s: %v", caCertFile, err)
+	}
+
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(pem); !ok {
+		return nil, fmt.Errorf("could not parse any certificates from CA cert file %s", caCertFile)
+	}
+
+	return pool, nil
+}